@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"go/build"
 	"io/ioutil"
 	"log"
@@ -19,7 +21,6 @@ import (
 const (
 	hookPackage    = "github.com/juju/gocharm/hook"
 	autogenMessage = `This file is automatically generated. Do not edit.`
-	godepPath      = `github.com/tools/godep`
 )
 
 var hookMainCode = template.Must(template.New("").Parse(`
@@ -75,31 +76,234 @@ type buildCharmParams struct {
 	// This also implies that the hooks will have the
 	// capability to recompile.
 	source bool
+
+	// Targets holds the set of architectures that the runhook
+	// binary should be cross-compiled for. If it is empty,
+	// defaultBuildTarget is used.
+	Targets []BuildTarget
+
+	// Hooks holds commands to run before and after the charm is
+	// built. If it is empty, it is populated from a gocharm.yaml
+	// file found alongside the source package; see
+	// loadGocharmConfig. A caller-supplied Hooks always takes
+	// precedence over gocharm.yaml, mirroring how Targets is only
+	// defaulted, never overridden, by b.targets().
+	Hooks hooksConfig
+}
+
+// HookCmd describes a single external command to run as part of a
+// pre-build or post-build hook declared in gocharm.yaml. Cmd, Args,
+// Env and Dir are all expanded as templates before use; see hookVars
+// for the fields available to them.
+type HookCmd struct {
+	Cmd  string
+	Args []string
+	Env  []string
+	Dir  string
+}
+
+// hooksConfig holds the pre- and post-build hooks to run around
+// buildCharm, whether set directly on buildCharmParams or read from
+// a gocharm.yaml file by loadGocharmConfig.
+type hooksConfig struct {
+	Pre  []HookCmd `yaml:"pre"`
+	Post []HookCmd `yaml:"post"`
+}
+
+// hookVars holds the values made available to HookCmd templates.
+// GOOS and GOARCH reflect the first of buildCharmParams.Targets (or
+// defaultBuildTarget if none were given): Pre and Post hooks run once
+// per build, not once per cross-compilation target, so there isn't a
+// single correct value when Targets has more than one entry.
+type hookVars struct {
+	CharmDir string
+	PkgDir   string
+	TempDir  string
+	GOOS     string
+	GOARCH   string
+}
+
+// gocharmConfig holds the contents of an optional gocharm.yaml file
+// found in a charm's source package.
+type gocharmConfig struct {
+	Hooks hooksConfig `yaml:"hooks"`
+}
+
+// loadGocharmConfig reads gocharm.yaml from pkgDir, if present. It is
+// not an error for the file to be absent, in which case a zero
+// gocharmConfig is returned.
+func loadGocharmConfig(pkgDir string) (gocharmConfig, error) {
+	var cfg gocharmConfig
+	data, err := ioutil.ReadFile(filepath.Join(pkgDir, "gocharm.yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrap(err)
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "cannot parse gocharm.yaml")
+	}
+	return cfg, nil
+}
+
+// runHooks runs each of the given hooks in turn, expanding their
+// Cmd, Args, Env and Dir fields as templates against v.
+func (b *charmBuilder) runHooks(hooks []HookCmd, v hookVars) error {
+	for _, h := range hooks {
+		cmd, err := expandHookVar(h.Cmd, v)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		args := make([]string, len(h.Args))
+		for i, a := range h.Args {
+			if args[i], err = expandHookVar(a, v); err != nil {
+				return errors.Wrap(err)
+			}
+		}
+		env := os.Environ()
+		for _, e := range h.Env {
+			ee, err := expandHookVar(e, v)
+			if err != nil {
+				return errors.Wrap(err)
+			}
+			env = setenv(env, ee)
+		}
+		dir := v.CharmDir
+		if h.Dir != "" {
+			if dir, err = expandHookVar(h.Dir, v); err != nil {
+				return errors.Wrap(err)
+			}
+		}
+		if err := runCmd(dir, env, cmd, args...).Run(); err != nil {
+			return errors.Wrapf(err, "hook %q failed", cmd)
+		}
+	}
+	return nil
+}
+
+// expandHookVar expands a single HookCmd field as a template against v.
+func expandHookVar(s string, v hookVars) (string, error) {
+	t, err := template.New("").Parse(s)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	var w bytes.Buffer
+	if err := t.Execute(&w, v); err != nil {
+		return "", errors.Wrap(err)
+	}
+	return w.String(), nil
+}
+
+// BuildTarget describes a single cross-compilation target for the
+// runhook binary. Each target produces its own binary, named
+// bin/runhook.<suffix> (see BuildTarget.suffix), so that a single charm can carry
+// binaries for several series/architectures at once.
+type BuildTarget struct {
+	// GOOS holds the target operating system.
+	GOOS string
+
+	// GOARCH holds the target architecture.
+	GOARCH string
+
+	// GOARM holds the ARM variant to build for, when GOARCH is "arm".
+	// It is ignored for other architectures.
+	GOARM string
+
+	// CGOEnabled specifies whether cgo is enabled for this target.
+	// It defaults to false, which is what's needed to produce a
+	// statically linked binary (for example against musl).
+	CGOEnabled bool
+
+	// ExtraLDFlags holds additional flags to pass to "go build -ldflags".
+	ExtraLDFlags string
+
+	// Tags holds additional build tags to pass to "go build -tags".
+	Tags []string
+}
+
+// defaultBuildTarget is used when buildCharmParams.Targets is empty,
+// preserving the historical amd64/linux-only behaviour.
+var defaultBuildTarget = BuildTarget{
+	GOOS:   "linux",
+	GOARCH: "amd64",
+}
+
+// suffix returns the string used to distinguish this target's binary
+// from the others, as used in the bin/runhook.<suffix> filename and by
+// the install hook's uname-based lookup. GOARM is included so that
+// targets differing only by ARM variant (e.g. armv6 vs armv7) don't
+// collide on the same filename.
+func (t BuildTarget) suffix() string {
+	s := t.GOOS + "-" + t.GOARCH
+	if t.GOARCH == "arm" && t.GOARM != "" {
+		s += "v" + t.GOARM
+	}
+	return s
 }
 
 type charmBuilder buildCharmParams
 
+// targets returns the build targets to compile for, falling back to
+// defaultBuildTarget if none were specified.
+func (b *charmBuilder) targets() []BuildTarget {
+	if len(b.Targets) == 0 {
+		return []BuildTarget{defaultBuildTarget}
+	}
+	return b.Targets
+}
+
 // buildCharm builds the runhook executable,
 // and all the other charm pieces (hooks, metadata.yaml,
 // config.yaml). It puts the runhook source file into goFile
 // and the runhook executable into exe.
 func buildCharm(p buildCharmParams) error {
 	b := (*charmBuilder)(&p)
+	cfg, err := loadGocharmConfig(b.pkg.Dir)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read gocharm.yaml")
+	}
+	if len(b.Hooks.Pre) == 0 && len(b.Hooks.Post) == 0 {
+		b.Hooks = cfg.Hooks
+	}
+	// Pre/Post hooks run once per build rather than once per
+	// target, so GOOS/GOARCH reflect the primary (first) target;
+	// see the hookVars doc comment.
+	primary := b.targets()[0]
+	vars := hookVars{
+		CharmDir: b.charmDir,
+		PkgDir:   b.pkg.Dir,
+		TempDir:  b.tempDir,
+		GOOS:     primary.GOOS,
+		GOARCH:   primary.GOARCH,
+	}
+	if err := b.runHooks(b.Hooks.Pre, vars); err != nil {
+		return errors.Wrapf(err, "pre-build hook failed")
+	}
 	code := generateCode(hookMainCode, b.pkg.ImportPath)
-	var exe string
+	goFile := filepath.Join(b.charmDir, "src", "runhook", "runhook.go")
 	if b.source {
 		// Build the runhook executable anyway, just to be sure
-		// that we can, but discard it.
-		exe = filepath.Join(b.tempDir, "runhook")
+		// that we can, but discard it. The actual target is
+		// chosen at deploy time when the charm recompiles from
+		// source, so a single sanity build is enough.
+		exe := filepath.Join(b.tempDir, "runhook")
+		if err := compile(goFile, exe, code, defaultBuildTarget); err != nil {
+			return errors.Wrapf(err, "cannot build hooks main package")
+		}
+		if _, err := os.Stat(exe); err != nil {
+			return errors.New("runhook command not built")
+		}
 	} else {
-		exe = filepath.Join(b.charmDir, "bin", "runhook")
-	}
-	goFile := filepath.Join(b.charmDir, "src", "runhook", "runhook.go")
-	if err := compile(goFile, exe, code, true); err != nil {
-		return errors.Wrapf(err, "cannot build hooks main package")
-	}
-	if _, err := os.Stat(exe); err != nil {
-		return errors.New("runhook command not built")
+		for _, t := range b.targets() {
+			exe := filepath.Join(b.charmDir, "bin", "runhook."+t.suffix())
+			if err := compile(goFile, exe, code, t); err != nil {
+				return errors.Wrapf(err, "cannot build hooks main package for %s", t.suffix())
+			}
+			if _, err := os.Stat(exe); err != nil {
+				return errors.New("runhook command not built")
+			}
+		}
 	}
 	info, err := registeredCharmInfo(p.pkg.ImportPath, p.tempDir)
 	if err != nil {
@@ -114,11 +318,26 @@ func buildCharm(p buildCharmParams) error {
 	if err := b.writeConfig(info.Config); err != nil {
 		return errors.Wrapf(err, "cannot write config.yaml")
 	}
+	if err := b.writeArtifacts(info.Hooks); err != nil {
+		return errors.Wrapf(err, "cannot write artifacts")
+	}
 	// Sanity check that the new config files parse correctly.
 	_, err = charm.ReadCharmDir(b.charmDir)
 	if err != nil {
 		return errors.Wrapf(err, "charm will not read correctly; we've broken it, sorry")
 	}
+	if err := b.runHooks(b.Hooks.Post, vars); err != nil {
+		return errors.Wrapf(err, "post-build hook failed")
+	}
+	// The manifest is computed after Post hooks run so that a hook
+	// which signs, strips or otherwise touches the runhook binary
+	// (see HookCmd) doesn't invalidate the checksums verify-runhook
+	// relies on.
+	if !b.source {
+		if err := b.writeManifest(); err != nil {
+			return errors.Wrapf(err, "cannot write bin/manifest.yaml")
+		}
+	}
 	if b.source {
 		if err := b.vendorDeps(); err != nil {
 			return errors.Wrapf(err, "cannot get dependencies")
@@ -163,39 +382,62 @@ func (b *charmBuilder) writeHooks(hooks []string) error {
 
 // hookStubTemplate holds the template for the generated hook code.
 // The apt-get flags are stolen from github.com/juju/utils/apt
+//
+// The install hook installs any *.snap file found under snap/ in
+// place of the apt-get packages, and installs and enables a systemd
+// unit found under lib/systemd/system/. The built-in snapEmitter
+// writes only snap/snapcraft.yaml and its staging tree, not a built
+// .snap file, so apt-get is still used unless a .snap file has been
+// added under snap/.
+//
+// For precompiled charms (not .Source), the stub never execs
+// $CHARM_DIR/bin/runhook blindly: the first time it runs on a unit it
+// runs verify-runhook, which consults bin/manifest.yaml to pick the
+// binary for this unit's architecture, checksums it, and only then
+// stages it as $CHARM_DIR/bin/runhook. Later hook invocations reuse
+// that already-verified binary rather than re-hashing it on every
+// call (relation-changed and update-status hooks fire often).
 var hookStubTemplate = template.Must(template.New("").Parse(`#!/bin/sh
 set -ex
 {{if eq .HookName "install"}}
-apt-get '--option=Dpkg::Options::=--force-confold'  '--option=Dpkg::options::=--force-unsafe-io' --assume-yes --quiet install golang git mercurial
+if ls "$CHARM_DIR"/snap/*.snap >/dev/null 2>&1; then
+	snap install --dangerous "$CHARM_DIR"/snap/*.snap
+else
+	apt-get '--option=Dpkg::Options::=--force-confold'  '--option=Dpkg::options::=--force-unsafe-io' --assume-yes --quiet install golang git mercurial
+fi
 
-if test -e "$CHARM_DIR/bin/runhook"; then
-	# the binary has been pre-compiled; no need to compile again.
-	exit 0
+if test -e "$CHARM_DIR/lib/systemd/system/{{.Name}}.service"; then
+	cp "$CHARM_DIR/lib/systemd/system/{{.Name}}.service" "/etc/systemd/system/{{.Name}}.service"
+	systemctl daemon-reload
+	systemctl enable --now "{{.Name}}.service"
 fi
-export GOPATH="$CHARM_DIR"
-go get {{.GodepPath}}
 
-"$CHARM_DIR/compile"
-"$CHARM_DIR/bin/runhook" install
-{{else if  .Source}}
-if test -e "$CHARM_DIR/compile-always"; then
+{{end}}
+{{if .Source}}
+if test "{{.HookName}}" = "install" || test -e "$CHARM_DIR/compile-always"; then
 	"$CHARM_DIR/compile"
 fi
+{{else}}
+if test ! -e "$CHARM_DIR/bin/runhook"; then
+	"$CHARM_DIR/bin/verify-runhook"
+fi
 {{end}}
 $CHARM_DIR/bin/runhook {{.HookName}}
 `))
 
 type hookStubParams struct {
-	Source    bool
-	HookName  string
-	GodepPath string
+	Source   bool
+	HookName string
+	// Name is the charm name, used to look up the bundled systemd
+	// unit (if any) under lib/systemd/system.
+	Name string
 }
 
 func (b *charmBuilder) hookStub(hookName string) []byte {
 	return executeTemplate(hookStubTemplate, hookStubParams{
-		Source:    b.source,
-		HookName:  hookName,
-		GodepPath: godepPath,
+		Source:   b.source,
+		HookName: hookName,
+		Name:     filepath.Base(b.pkg.Dir),
 	})
 }
 
@@ -261,31 +503,361 @@ func (b *charmBuilder) writeConfig(config map[string]charm.Option) error {
 	return nil
 }
 
-var listSep = string(filepath.ListSeparator)
+// manifestEntry records the checksum of one runhook binary shipped in
+// the charm, as written to bin/manifest.yaml by writeManifest.
+type manifestEntry struct {
+	OS   string `yaml:"os"`
+	Arch string `yaml:"arch"`
+	// GOARM holds the ARM variant this entry was built for (see
+	// BuildTarget.GOARM); it is empty for non-arm targets.
+	GOARM  string `yaml:"goarm"`
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Size   int64  `yaml:"size"`
+}
 
-func (b *charmBuilder) vendorDeps() error {
-	dir := filepath.Join(b.charmDir, "src", "runhook")
-	// godep save requires the base package to be in a VCS, for
-	// some odd reason, so we create one and then destroy it.
-	gitCmd := runCmd(dir, nil, "git", "init")
-	gitCmd.Stdout = nil // We don't want the chat.
-	if err := gitCmd.Run(); err != nil {
-		return errors.Wrapf(err, "cannot git init directory")
-	}
-	defer os.RemoveAll(filepath.Join(dir, ".git"))
-	// We put the existing GOPATH at the start so that it doesn't matter that
-	// we have already copied the charm's source code into $charmdir/src
-	// and that it doesn't have an associated VCS.
-	env := setenv(os.Environ(), "GOPATH="+os.Getenv("GOPATH")+listSep+b.charmDir)
-	if err := runCmd(dir, env, "godep", "save").Run(); err != nil {
-		if isExecNotFound(err) {
-			return errors.Newf("godep executable not found; get it with: go get %s", godepPath)
+// writeManifest computes a checksummed manifest of the
+// bin/runhook.<suffix> binaries built for b.targets(), writes it
+// to bin/manifest.yaml, and installs the verify-runhook helper script
+// that the generated hooks use to pick and checksum-verify the right
+// binary for the unit they're running on. It must be called after
+// all of b.targets() have been compiled into b.charmDir.
+func (b *charmBuilder) writeManifest() error {
+	var entries []manifestEntry
+	for _, t := range b.targets() {
+		relPath := filepath.Join("bin", "runhook."+t.suffix())
+		data, err := ioutil.ReadFile(filepath.Join(b.charmDir, relPath))
+		if err != nil {
+			return errors.Wrap(err)
 		}
+		sum := sha256.Sum256(data)
+		goarm := ""
+		if t.GOARCH == "arm" {
+			goarm = t.GOARM
+		}
+		entries = append(entries, manifestEntry{
+			OS:     t.GOOS,
+			Arch:   t.GOARCH,
+			GOARM:  goarm,
+			Path:   relPath,
+			SHA256: hex.EncodeToString(sum[:]),
+			Size:   int64(len(data)),
+		})
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "bin", "manifest.yaml"), entries); err != nil {
+		return errors.Wrapf(err, "cannot write bin/manifest.yaml")
+	}
+	verifyPath := filepath.Join(b.charmDir, "bin", "verify-runhook")
+	if err := ioutil.WriteFile(verifyPath, []byte(verifyRunhookScript), 0755); err != nil {
 		return errors.Wrap(err)
 	}
 	return nil
 }
 
+// verifyRunhookScript picks the bin/runhook.<suffix> binary that
+// matches the unit it runs on from bin/manifest.yaml, checks its
+// sha256 against the recorded digest, and only then stages it as
+// $CHARM_DIR/bin/runhook. It refuses to run, logging the expected and
+// actual digests via juju-log, if the checksum doesn't match.
+var verifyRunhookScript = `#!/bin/sh
+# ` + autogenMessage + `
+set -e
+goos=$(uname -s | tr '[:upper:]' '[:lower:]')
+uname_m=$(uname -m)
+goarch="$uname_m"
+goarm=""
+case "$uname_m" in
+	x86_64) goarch=amd64 ;;
+	aarch64) goarch=arm64 ;;
+	armv6l) goarch=arm; goarm=6 ;;
+	armv7l) goarch=arm; goarm=7 ;;
+	ppc64le) goarch=ppc64le ;;
+	s390x) goarch=s390x ;;
+esac
+manifest="$CHARM_DIR/bin/manifest.yaml"
+entry=$(awk -v goos="$goos" -v goarch="$goarch" -v goarm="$goarm" '
+	/^- os:/ { os=$3; arch=""; entry_goarm=""; path=""; sha="" }
+	/^  arch:/ { arch=$2 }
+	/^  goarm:/ { entry_goarm=$2; gsub(/"/, "", entry_goarm) }
+	/^  path:/ { path=$2 }
+	/^  sha256:/ {
+		sha=$2
+		if (os == goos && arch == goarch && entry_goarm == goarm) {
+			print path "\t" sha
+		}
+	}
+' "$manifest")
+if test -z "$entry"; then
+	juju-log "gocharm: no runhook binary in manifest for $goos-$goarch"
+	exit 1
+fi
+path=$(printf '%s' "$entry" | cut -f1)
+want_sha=$(printf '%s' "$entry" | cut -f2)
+got_sha=$(sha256sum "$CHARM_DIR/$path" | cut -d' ' -f1)
+if test "$got_sha" != "$want_sha"; then
+	juju-log "gocharm: checksum mismatch for $path: expected $want_sha, got $got_sha"
+	exit 1
+fi
+cp "$CHARM_DIR/$path" "$CHARM_DIR/bin/runhook"
+chmod +x "$CHARM_DIR/bin/runhook"
+`
+
+// ArtifactEmitter generates additional files to bundle into the
+// charm, beyond the hooks, metadata.yaml and config.yaml that
+// buildCharm always writes. Built-in emitters are listed in
+// builtinArtifactEmitters; more can be added without rebuilding
+// gocharm by dropping an executable under a GOCHARM_PLUGINS
+// directory; see loadArtifactPlugins.
+type ArtifactEmitter interface {
+	// Name identifies the emitter in log messages.
+	Name() string
+
+	// Emit writes whatever artifacts the emitter contributes,
+	// given the charm's build parameters and the names of its
+	// registered hooks.
+	Emit(b *charmBuilder, hooks []string) error
+}
+
+var builtinArtifactEmitters = []ArtifactEmitter{
+	systemdEmitter{},
+	snapEmitter{},
+}
+
+// writeArtifacts runs every registered ArtifactEmitter, built-in and
+// plugin, so that each can write whatever extra files it contributes
+// to the charm directory.
+func (b *charmBuilder) writeArtifacts(hooks []string) error {
+	plugins, err := loadArtifactPlugins()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	emitters := append(append([]ArtifactEmitter{}, builtinArtifactEmitters...), plugins...)
+	for _, e := range emitters {
+		if *verbose {
+			log.Printf("writing artifacts from %s", e.Name())
+		}
+		if err := e.Emit(b, hooks); err != nil {
+			return errors.Wrapf(err, "cannot write %s artifacts", e.Name())
+		}
+	}
+	return nil
+}
+
+// loadArtifactPlugins discovers ArtifactEmitters from the directories
+// listed in the GOCHARM_PLUGINS environment variable (colon-separated,
+// in the manner of GOPATH), in the spirit of how helm finds its
+// plugins. Each subdirectory of a GOCHARM_PLUGINS entry that contains
+// an executable named "artifacts" is registered as a plugin emitter
+// named after that subdirectory; the executable is run with CHARM_DIR,
+// PKG_DIR and TEMP_DIR set in its environment and is expected to write
+// its artifacts directly into CHARM_DIR.
+func loadArtifactPlugins() ([]ArtifactEmitter, error) {
+	var emitters []ArtifactEmitter
+	for _, dir := range filepath.SplitList(os.Getenv("GOCHARM_PLUGINS")) {
+		if dir == "" {
+			continue
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err)
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, info.Name(), "artifacts")
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			emitters = append(emitters, pluginArtifactEmitter{
+				name: info.Name(),
+				path: path,
+			})
+		}
+	}
+	return emitters, nil
+}
+
+// pluginArtifactEmitter wraps an external "artifacts" executable
+// discovered by loadArtifactPlugins.
+type pluginArtifactEmitter struct {
+	name string
+	path string
+}
+
+func (p pluginArtifactEmitter) Name() string {
+	return p.name
+}
+
+func (p pluginArtifactEmitter) Emit(b *charmBuilder, hooks []string) error {
+	env := setenv(os.Environ(), "CHARM_DIR="+b.charmDir)
+	env = setenv(env, "PKG_DIR="+b.pkg.Dir)
+	env = setenv(env, "TEMP_DIR="+b.tempDir)
+	if err := runCmd(b.charmDir, env, p.path).Run(); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+func hasHook(hooks []string, name string) bool {
+	for _, h := range hooks {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdEmitter writes a systemd unit file that runs the charm's
+// runhook binary as a long-running service, for charms that register
+// a "start" hook (by convention paired with a "stop" hook to tear the
+// service down again). It does nothing for charms with no such hook.
+type systemdEmitter struct{}
+
+func (systemdEmitter) Name() string { return "systemd" }
+
+func (systemdEmitter) Emit(b *charmBuilder, hooks []string) error {
+	if !hasHook(hooks, "start") {
+		return nil
+	}
+	unitDir := filepath.Join(b.charmDir, "lib", "systemd", "system")
+	if err := os.MkdirAll(unitDir, 0777); err != nil {
+		return errors.Wrap(err)
+	}
+	name := filepath.Base(b.pkg.Dir)
+	unit := executeTemplate(systemdUnitTemplate, systemdUnitParams{
+		AutogenMessage: autogenMessage,
+		Name:           name,
+	})
+	unitPath := filepath.Join(unitDir, name+".service")
+	if err := ioutil.WriteFile(unitPath, unit, 0644); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+var systemdUnitTemplate = template.Must(template.New("").Parse(`[Unit]
+# {{.AutogenMessage}}
+Description={{.Name}} (gocharm-managed service)
+After=network.target
+
+[Service]
+Type=simple
+ExecStart=${CHARM_DIR}/bin/runhook start
+ExecStop=${CHARM_DIR}/bin/runhook stop
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+type systemdUnitParams struct {
+	AutogenMessage string
+	Name           string
+}
+
+// snapEmitter writes a snapcraft.yaml and a local staging tree under
+// snap/, so the charm can be built as a locally-bundled, strictly
+// confined snap and installed without pulling golang/git/mercurial
+// from the Ubuntu archive.
+type snapEmitter struct{}
+
+func (snapEmitter) Name() string { return "snap" }
+
+func (snapEmitter) Emit(b *charmBuilder, hooks []string) error {
+	if b.source {
+		// In source-recompile mode, charmDir/bin is never populated
+		// at build time (it's filled in on the unit by the compile
+		// script), so
+		// there are no pre-built binaries to stage into the snap.
+		return nil
+	}
+	snapDir := filepath.Join(b.charmDir, "snap")
+	stageDir := filepath.Join(snapDir, "local", "bin")
+	if err := os.MkdirAll(stageDir, 0777); err != nil {
+		return errors.Wrap(err)
+	}
+	name := filepath.Base(b.pkg.Dir)
+	snapcraft := executeTemplate(snapcraftTemplate, snapcraftParams{
+		AutogenMessage: autogenMessage,
+		Name:           name,
+	})
+	if err := ioutil.WriteFile(filepath.Join(snapDir, "snapcraft.yaml"), snapcraft, 0644); err != nil {
+		return errors.Wrap(err)
+	}
+	// A snap is built for a single architecture, so only the primary
+	// target's binary is staged, renamed to the fixed "runhook" name
+	// that apps.runhook.command in snapcraftTemplate expects (the
+	// per-target bin/runhook.<suffix> filenames built for the charm
+	// itself don't apply inside the snap).
+	primary := b.targets()[0]
+	binPath := filepath.Join(b.charmDir, "bin", "runhook."+primary.suffix())
+	data, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(stageDir, "runhook"), data, 0755); err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+var snapcraftTemplate = template.Must(template.New("").Parse(`# {{.AutogenMessage}}
+name: {{.Name}}
+version: "1.0"
+summary: {{.Name}} runhook, bundled for confined installs
+description: |
+  The runhook binary for the {{.Name}} charm, staged so the install hook
+  can "snap install --dangerous" it instead of reaching apt.
+confinement: strict
+grade: stable
+
+parts:
+  runhook:
+    plugin: dump
+    source: local/bin
+    organize:
+      '*': bin/
+
+apps:
+  runhook:
+    command: bin/runhook
+`))
+
+type snapcraftParams struct {
+	AutogenMessage string
+	Name           string
+}
+
+func (b *charmBuilder) vendorDeps() error {
+	dir := filepath.Join(b.charmDir, "src", "runhook")
+	env := setenv(os.Environ(), "GO111MODULE=on")
+	// runhook.go imports the charm package by its real import path
+	// (b.pkg.ImportPath), so the module we create here must use a
+	// different module path - otherwise "go mod init b.pkg.ImportPath"
+	// makes the runhook main package import itself, and the build
+	// fails with "import cycle not allowed". A replace directive then
+	// points that import path back at the charm's source directory,
+	// so "go mod vendor" can vendor it straight from disk instead of
+	// needing it published under a resolvable module proxy.
+	if err := runCmd(dir, env, "go", "mod", "init", "runhook").Run(); err != nil {
+		return errors.Wrapf(err, "cannot create go.mod")
+	}
+	if err := runCmd(dir, env, "go", "mod", "edit", "-replace", b.pkg.ImportPath+"="+b.pkg.Dir).Run(); err != nil {
+		return errors.Wrapf(err, "cannot add replace directive for %s", b.pkg.ImportPath)
+	}
+	if err := runCmd(dir, env, "go", "mod", "tidy").Run(); err != nil {
+		return errors.Wrapf(err, "cannot tidy go.mod")
+	}
+	if err := runCmd(dir, env, "go", "mod", "vendor").Run(); err != nil {
+		return errors.Wrapf(err, "cannot vendor dependencies")
+	}
+	return nil
+}
+
 func setenv(env []string, entry string) []string {
 	i := strings.Index(entry, "=")
 	if i == -1 {
@@ -315,12 +887,17 @@ func generateCode(tmpl *template.Template, charmPackage string) []byte {
 	})
 }
 
-func compile(goFile, exeFile string, mainCode []byte, crossCompile bool) error {
+func compile(goFile, exeFile string, mainCode []byte, t BuildTarget) error {
 	env := os.Environ()
-	if crossCompile {
-		env = setenv(env, "CGOENABLED=false")
-		env = setenv(env, "GOARCH=amd64")
-		env = setenv(env, "GOOS=linux")
+	env = setenv(env, "GOOS="+t.GOOS)
+	env = setenv(env, "GOARCH="+t.GOARCH)
+	if t.CGOEnabled {
+		env = setenv(env, "CGO_ENABLED=1")
+	} else {
+		env = setenv(env, "CGO_ENABLED=0")
+	}
+	if t.GOARM != "" {
+		env = setenv(env, "GOARM="+t.GOARM)
 	}
 	if err := os.MkdirAll(filepath.Dir(goFile), 0777); err != nil {
 		return errors.Wrap(err)
@@ -331,7 +908,15 @@ func compile(goFile, exeFile string, mainCode []byte, crossCompile bool) error {
 	if err := ioutil.WriteFile(goFile, mainCode, 0666); err != nil {
 		return errors.Wrap(err)
 	}
-	if err := runCmd("", env, "go", "build", "-o", exeFile, goFile).Run(); err != nil {
+	args := []string{"build", "-o", exeFile}
+	if t.ExtraLDFlags != "" {
+		args = append(args, "-ldflags", t.ExtraLDFlags)
+	}
+	if len(t.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(t.Tags, " "))
+	}
+	args = append(args, goFile)
+	if err := runCmd("", env, "go", args...).Run(); err != nil {
 		return errors.Wrapf(err, "failed to build")
 	}
 	return nil
@@ -349,11 +934,6 @@ func runCmd(dir string, env []string, cmd string, args ...string) *exec.Cmd {
 	return c
 }
 
-func isExecNotFound(err error) bool {
-	e, ok := err.(*exec.Error)
-	return ok && e.Err == exec.ErrNotFound
-}
-
 func executeTemplate(t *template.Template, param interface{}) []byte {
 	var w bytes.Buffer
 	if err := t.Execute(&w, param); err != nil {
@@ -370,6 +950,8 @@ if test -z "$CHARM_DIR"; then
 fi
 export PATH="$CHARM_DIR/bin:$PATH"
 cd "$CHARM_DIR/src/runhook"
-export GOPATH="$CHARM_DIR:$(godep path)"
+export GO111MODULE=on
+export GOFLAGS=-mod=vendor
+export GOBIN="$CHARM_DIR/bin"
 go install
 `